@@ -78,14 +78,47 @@ package runfiles
 
 import (
 	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
 )
 
+var (
+	// ErrEmptyRlocation is returned by RlocationE when called with an empty
+	// path.
+	ErrEmptyRlocation = errors.New("runfiles: rlocation path must not be empty")
+	// ErrInvalidRlocation is returned by RlocationE when called with a path
+	// that starts with "../" or "./", ends with "/.", or contains "/..",
+	// "/./" or "//". A path that is just "." or ".." is not rejected.
+	ErrInvalidRlocation = errors.New("runfiles: invalid rlocation path")
+	// ErrManifestRead is returned by CreateFromE when the runfiles manifest
+	// exists but could not be opened or read.
+	ErrManifestRead = errors.New("runfiles: could not read manifest file")
+)
+
+// CurrentRepository is the canonical name of the repository containing the
+// package that was built into the calling binary, as seen by Bazel. It is
+// empty unless stamped in by the linker, e.g. via:
+//
+//   go_binary(
+//       name = "my_binary",
+//       x_defs = {"github.com/bazelbuild/rules_go/go/tools/bazel/runfiles.CurrentRepository": "{canonical_repo_name}"},
+//   )
+//
+// go_binary and go_test rules that are Bzlmod-aware stamp this automatically.
+var CurrentRepository string
+
 type Runfiles interface {
 	Rlocation(string) string
+	RlocationE(string) (string, error)
 	Envvars() map[string]string
 }
 
@@ -101,12 +134,35 @@ func CreateForTest() *_RunfilesImpl {
 		os.Getenv("TEST_SRCDIR"))
 }
 
+// CreateE is like Create, except that it reports errors (e.g. a manifest
+// file that exists but cannot be read) instead of panicking. It returns a nil
+// Runfiles and a nil error if the process was not started by Bazel, i.e. if
+// runfiles are simply unavailable.
+func CreateE() (Runfiles, error) {
+	r, err := CreateFromE(
+		os.Args[0], os.Getenv("RUNFILES_MANIFEST_FILE"),
+		os.Getenv("RUNFILES_DIR"))
+	if err != nil || r == nil {
+		return nil, err
+	}
+	return r, nil
+}
 
 func CreateFrom(argv0 string, env_mf string, env_dir string) *_RunfilesImpl {
+	r, err := CreateFromE(argv0, env_mf, env_dir)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// CreateFromE is like CreateFrom, except that it reports errors instead of
+// panicking.
+func CreateFromE(argv0 string, env_mf string, env_dir string) (*_RunfilesImpl, error) {
 	env_mf, env_dir = discoverPaths(
 		argv0, env_mf, env_dir, defaultIsManifest, defaultIsDirectory)
 	if len(env_mf) == 0 && len(env_dir) == 0 {
-		return nil
+		return nil, nil
 	}
 	var env_map = map[string]string {
 		 "RUNFILES_MANIFEST_FILE": env_mf,
@@ -116,34 +172,47 @@ func CreateFrom(argv0 string, env_mf string, env_dir string) *_RunfilesImpl {
 		 "JAVA_RUNFILES": env_dir,
 	}
 
-	return &_RunfilesImpl{dir: env_dir, mf: readManifest(env_mf), env: env_map}
+	mf, err := readManifestE(env_mf)
+	if err != nil {
+		return nil, err
+	}
+	return &_RunfilesImpl{
+		dir:         env_dir,
+		mf:          mf,
+		env:         env_map,
+		repoMapping: readRepoMapping(env_dir, mf),
+	}, nil
 }
 
 type _RunfilesImpl struct {
 	dir	string
 	mf	map[string]string
 	env	map[string]string
+	// repoMapping maps (source canonical repo, target apparent repo) pairs to
+	// the target's canonical repo name. It is nil if this build predates
+	// Bzlmod repo mapping (the `_repo_mapping` file does not exist).
+	repoMapping map[[2]string]string
 }
 
-func readManifest(mf string) map[string]string {
+func readManifestE(mf string) (map[string]string, error) {
 	if len(mf) == 0 {
-		return nil
+		return nil, nil
 	}
 	f, err := os.Open(mf)
 	if err != nil {
-		panic("could not open file")
+		return nil, fmt.Errorf("%w: %v", ErrManifestRead, err)
 	}
 	defer f.Close()
 	dat, err := ioutil.ReadAll(f)
 	if err != nil {
-		panic("could not read file")
+		return nil, fmt.Errorf("%w: %v", ErrManifestRead, err)
 	}
 	result := make(map[string]string)
 	offs := 0
 	for {
 		adv, tkn, err := bufio.ScanLines(dat[offs:], true)
 		if err != nil {
-			panic("failed to read file")
+			return nil, fmt.Errorf("%w: %v", ErrManifestRead, err)
 		}
 		if adv == 0 {
 			break
@@ -155,12 +224,57 @@ func readManifest(mf string) map[string]string {
 			result[tokens[0]] = ""
 		}
 	}
+	return result, nil
+}
+
+// readRepoMapping looks for the `_repo_mapping` file, either directly under
+// dir or as an entry of mf, and parses it into a (source repo, target
+// apparent repo) -> target canonical repo lookup table. It returns nil if no
+// such file exists, which is the case for builds that predate Bzlmod.
+func readRepoMapping(dir string, mf map[string]string) map[[2]string]string {
+	var dat []byte
+	if len(dir) > 0 {
+		if d, err := ioutil.ReadFile(path.Join(dir, "_repo_mapping")); err == nil {
+			dat = d
+		}
+	}
+	if dat == nil && mf != nil {
+		if target, ok := mf["_repo_mapping"]; ok && len(target) > 0 {
+			if d, err := ioutil.ReadFile(target); err == nil {
+				dat = d
+			}
+		}
+	}
+	if dat == nil {
+		return nil
+	}
+
+	r := csv.NewReader(strings.NewReader(string(dat)))
+	r.FieldsPerRecord = 3
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil
+	}
+	result := make(map[[2]string]string, len(records))
+	for _, rec := range records {
+		result[[2]string{rec[0], rec[1]}] = rec[2]
+	}
 	return result
 }
 
 func (r *_RunfilesImpl) Rlocation(rpath string) string {
+	p, err := r.RlocationE(rpath)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// RlocationE is like Rlocation, except that it reports a malformed rpath as
+// an error instead of panicking.
+func (r *_RunfilesImpl) RlocationE(rpath string) (string, error) {
 	if len(rpath) == 0 {
-		panic("foo")
+		return "", ErrEmptyRlocation
 	}
 	if strings.HasPrefix(rpath, "../") ||
 		strings.Contains(rpath, "/..") ||
@@ -168,17 +282,188 @@ func (r *_RunfilesImpl) Rlocation(rpath string) string {
 		strings.Contains(rpath, "/./") ||
 		strings.HasSuffix(rpath, "/.") ||
 		strings.Contains(rpath, "//") {
-		panic("bar")
+		return "", ErrInvalidRlocation
 	}
 
 	if path.IsAbs(rpath) {
-		return rpath
+		return rpath, nil
 	}
 	if len(r.mf) > 0 {
-		return r.mf[rpath]
-	} else {
-		return path.Join(r.dir, rpath)
+		return r.mf[rpath], nil
 	}
+	return path.Join(r.dir, rpath), nil
+}
+
+// RlocationFrom resolves rpath the same way Rlocation does, except that
+// rpath's leading repository name is first treated as an apparent repository
+// name relative to sourceRepo and rewritten to the corresponding canonical
+// repository name using the `_repo_mapping` manifest, if one is present. This
+// lets code in one repository reference runfiles of a dependency by the name
+// it uses for that dependency, even under Bzlmod where canonical repository
+// names carry version information.
+//
+// Use WithSourceRepo to obtain a Runfiles value that always resolves paths
+// relative to a fixed sourceRepo, e.g. CurrentRepository.
+func (r *_RunfilesImpl) RlocationFrom(rpath string, sourceRepo string) string {
+	p, err := r.RlocationFromE(rpath, sourceRepo)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// RlocationFromE is like RlocationFrom, except that it reports a malformed
+// rpath as an error instead of panicking.
+func (r *_RunfilesImpl) RlocationFromE(rpath string, sourceRepo string) (string, error) {
+	if len(r.repoMapping) > 0 {
+		firstSegment := rpath
+		rest := ""
+		if idx := strings.IndexByte(rpath, '/'); idx >= 0 {
+			firstSegment = rpath[:idx]
+			rest = rpath[idx:]
+		}
+		if canonical, ok := r.repoMapping[[2]string{sourceRepo, firstSegment}]; ok {
+			rpath = canonical + rest
+		}
+	}
+	return r.RlocationE(rpath)
+}
+
+// WithSourceRepo returns a Runfiles value whose Rlocation resolves apparent
+// repository names relative to repo, as RlocationFrom does.
+func WithSourceRepo(r Runfiles, repo string) Runfiles {
+	return &_RunfilesWithSourceRepo{Runfiles: r, sourceRepo: repo}
+}
+
+type _RunfilesWithSourceRepo struct {
+	Runfiles
+	sourceRepo string
+}
+
+func (r *_RunfilesWithSourceRepo) Rlocation(rpath string) string {
+	p, err := r.RlocationE(rpath)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (r *_RunfilesWithSourceRepo) RlocationE(rpath string) (string, error) {
+	if impl, ok := r.Runfiles.(*_RunfilesImpl); ok {
+		return impl.RlocationFromE(rpath, r.sourceRepo)
+	}
+	return r.Runfiles.RlocationE(rpath)
+}
+
+// WithEnv sets the RUNFILES_MANIFEST_FILE, RUNFILES_DIR, and JAVA_RUNFILES
+// environment variables in cmd.Env, preserving whatever else cmd.Env already
+// contains, so that a child process started via os/exec can find its own
+// runfiles without the caller having to iterate Envvars() by hand. If
+// cmd.Env is nil, it is first populated with os.Environ() so the child still
+// inherits the current process's environment, matching the os/exec default
+// for a cmd.Env that WithEnv hasn't touched. Any pre-existing entries for
+// those three variables are then removed: since this process is itself
+// commonly run by Bazel, a naive append would leave stale values earlier in
+// cmd.Env, which most programs' environment lookups (e.g. getenv) resolve in
+// preference to ours.
+func (r *_RunfilesImpl) WithEnv(cmd *exec.Cmd) {
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	filtered := make([]string, 0, len(env)+len(r.env))
+	for _, kv := range env {
+		k := kv
+		if idx := strings.IndexByte(kv, '='); idx >= 0 {
+			k = kv[:idx]
+		}
+		if _, ok := r.env[k]; ok {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	for k, v := range r.env {
+		filtered = append(filtered, k+"="+v)
+	}
+	cmd.Env = filtered
+}
+
+// OpenRlocation resolves rpath via RlocationE and opens the resulting file.
+// It works the same way whether the deployment is manifest-only (e.g. on
+// Windows, or with --noenable_runfiles) or backed by a runfiles directory,
+// since in a manifest-only deployment it opens the manifest's target path
+// directly instead of requiring a symlink tree.
+func (r *_RunfilesImpl) OpenRlocation(rpath string) (io.ReadCloser, error) {
+	p, err := r.RlocationE(rpath)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("runfiles: %s: %w", rpath, os.ErrNotExist)
+	}
+	return os.Open(p)
+}
+
+// MaterializeTree builds a runfiles directory tree under dst that mirrors the
+// manifest, so that code which needs an actual directory (e.g. to chdir into
+// it, or to hand to a subprocess) can use one even when Bazel only provided a
+// manifest, as happens on Windows or with --noenable_runfiles. It creates a
+// symlink for every manifest entry that has a target path; entries with an
+// empty target are skipped, so no file is created for them. On Windows,
+// where creating a symlink commonly requires elevated privileges, it falls
+// back to a hardlink and finally to a copy. MaterializeTree returns dst on
+// success.
+func (r *_RunfilesImpl) MaterializeTree(dst string) (string, error) {
+	if len(r.mf) == 0 {
+		return "", errors.New("runfiles: MaterializeTree requires a runfiles manifest")
+	}
+	for rpath, target := range r.mf {
+		if len(target) == 0 {
+			continue
+		}
+		linkPath := filepath.Join(dst, filepath.FromSlash(rpath))
+		if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+			return "", fmt.Errorf("runfiles: MaterializeTree: %w", err)
+		}
+		if err := materializeLink(target, linkPath); err != nil {
+			return "", fmt.Errorf("runfiles: MaterializeTree: %w", err)
+		}
+	}
+	return dst, nil
+}
+
+// materializeLink makes linkPath refer to target's contents, preferring a
+// symlink. Only on Windows does a failed symlink fall back to a hardlink, and
+// then to a plain copy.
+func materializeLink(target, linkPath string) error {
+	os.Remove(linkPath)
+	err := os.Symlink(target, linkPath)
+	if err == nil || runtime.GOOS != "windows" {
+		return err
+	}
+	if err := os.Link(target, linkPath); err == nil {
+		return nil
+	}
+	return copyFile(target, linkPath)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
 }
 
 func (r *_RunfilesImpl) Envvars() map[string]string {
@@ -211,6 +496,12 @@ func defaultIsDirectory(dir string) bool {
 	return false
 }
 
+// discoverPaths implements the lookup strategy of the cross-language
+// runfiles discovery proposal: if only RUNFILES_MANIFEST_FILE is set, the
+// directory is derived from it (by stripping the "_manifest" or "/MANIFEST"
+// suffix) even if that directory doesn't exist on disk, so it can still be
+// propagated to child processes; if only RUNFILES_DIR is set, no manifest is
+// required at all; if neither is set, both are looked up near argv0.
 func discoverPaths(
 	argv0, mf, dir string,
 	isRunfilesManifest, isRunfilesDirectory func(string) bool) (out_manifest, out_directory string) {
@@ -221,41 +512,40 @@ func discoverPaths(
 
 	if !mfValid && !dirValid {
 		if len(argv0) > 0 {
-			mf = argv0 + ".runfiles/MANIFEST"
-			dir = argv0 + ".runfiles"
-			mfValid = isRunfilesManifest(mf)
-			dirValid = isRunfilesDirectory(dir)
-			if !mfValid {
-				mf = argv0 + ".runfiles_manifest"
-				mfValid = isRunfilesManifest(mf)
+			candidateDir := argv0 + ".runfiles"
+			if isRunfilesDirectory(candidateDir) {
+				dir = candidateDir
+				dirValid = true
 			}
-		}
-	}
 
-	if !mfValid && !dirValid {
-		return
-	}
-
-	if !mfValid {
-		mf = dir + "/MANIFEST"
-		mfValid = isRunfilesManifest(mf)
-		if !mfValid {
-			mf = dir + "_manifest"
-			mfValid = isRunfilesManifest(mf)
+			// Try the manifest next to argv0 independent of whether the
+			// runfiles directory exists: on a manifest-only deployment (e.g.
+			// Windows, or --noenable_runfiles) there is no runfiles dir at
+			// all, only a standalone manifest file.
+			candidateMf := argv0 + ".runfiles/MANIFEST"
+			if isRunfilesManifest(candidateMf) {
+				mf = candidateMf
+				mfValid = true
+			} else {
+				candidateMf = argv0 + ".runfiles_manifest"
+				if isRunfilesManifest(candidateMf) {
+					mf = candidateMf
+					mfValid = true
+				}
+			}
 		}
 	}
 
-	if !dirValid {
+	if mfValid && !dirValid {
 		const kSubstrLen = 9  // "_manifest" or "/MANIFEST"
 		dir = mf[:len(mf) - kSubstrLen]
-		dirValid = isRunfilesDirectory(dir)
 	}
 
 	if mfValid {
 		out_manifest = mf
 	}
 
-	if dirValid {
+	if dirValid || mfValid {
 		out_directory = dir
 	}
 	return
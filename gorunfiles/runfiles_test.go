@@ -0,0 +1,316 @@
+/* Copyright 2018 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runfiles
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDiscoverPathsManifestOnlyNextToArgv0(t *testing.T) {
+	// Simulates a manifest-only deployment (e.g. Windows, or
+	// --noenable_runfiles): argv0+".runfiles_manifest" exists, but there is no
+	// argv0+".runfiles" directory and no env vars are set.
+	dir := t.TempDir()
+	argv0 := filepath.Join(dir, "myprog")
+	mf := argv0 + ".runfiles_manifest"
+	if err := ioutil.WriteFile(mf, []byte("irrelevant"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotMf, gotDir := discoverPaths(argv0, "", "", defaultIsManifest, defaultIsDirectory)
+	if gotMf != mf {
+		t.Errorf("discoverPaths manifest = %q, want %q", gotMf, mf)
+	}
+	wantDir := argv0 + ".runfiles"
+	if gotDir != wantDir {
+		t.Errorf("discoverPaths directory = %q, want %q", gotDir, wantDir)
+	}
+}
+
+func TestDiscoverPathsNeitherEnvNorArgv0RunfilesExist(t *testing.T) {
+	dir := t.TempDir()
+	argv0 := filepath.Join(dir, "myprog")
+
+	gotMf, gotDir := discoverPaths(argv0, "", "", defaultIsManifest, defaultIsDirectory)
+	if gotMf != "" || gotDir != "" {
+		t.Errorf("discoverPaths = (%q, %q), want (\"\", \"\")", gotMf, gotDir)
+	}
+}
+
+func TestWithEnvReplacesStaleEntries(t *testing.T) {
+	r := &_RunfilesImpl{
+		env: map[string]string{
+			"RUNFILES_MANIFEST_FILE": "fresh-mf",
+			"RUNFILES_DIR":           "fresh-dir",
+			"JAVA_RUNFILES":          "fresh-dir",
+		},
+	}
+	cmd := &exec.Cmd{
+		Env: []string{
+			"RUNFILES_DIR=stale-dir",
+			"UNRELATED=keep-me",
+			"RUNFILES_MANIFEST_FILE=stale-mf",
+		},
+	}
+
+	r.WithEnv(cmd)
+
+	got := map[string]string{}
+	for _, kv := range cmd.Env {
+		k, v := kv, ""
+		for i := 0; i < len(kv); i++ {
+			if kv[i] == '=' {
+				k, v = kv[:i], kv[i+1:]
+				break
+			}
+		}
+		if prev, ok := got[k]; ok {
+			t.Fatalf("cmd.Env has duplicate key %q: %q and %q", k, prev, v)
+		}
+		got[k] = v
+	}
+
+	want := map[string]string{
+		"UNRELATED":              "keep-me",
+		"RUNFILES_MANIFEST_FILE": "fresh-mf",
+		"RUNFILES_DIR":           "fresh-dir",
+		"JAVA_RUNFILES":          "fresh-dir",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("cmd.Env[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("cmd.Env = %v, want exactly %v", got, want)
+	}
+}
+
+func TestWithEnvNilCmdEnvInheritsCurrentEnvironment(t *testing.T) {
+	if err := os.Setenv("RUNFILES_WITH_ENV_TEST_VAR", "still-here"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("RUNFILES_WITH_ENV_TEST_VAR")
+
+	r := &_RunfilesImpl{
+		env: map[string]string{
+			"RUNFILES_MANIFEST_FILE": "fresh-mf",
+			"RUNFILES_DIR":           "fresh-dir",
+			"JAVA_RUNFILES":          "fresh-dir",
+		},
+	}
+	cmd := &exec.Cmd{}
+
+	r.WithEnv(cmd)
+
+	found := false
+	for _, kv := range cmd.Env {
+		if kv == "RUNFILES_WITH_ENV_TEST_VAR=still-here" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("cmd.Env = %v, want it to still contain the inherited RUNFILES_WITH_ENV_TEST_VAR", cmd.Env)
+	}
+}
+
+func TestWithSourceRepoRlocationEAppliesRepoMapping(t *testing.T) {
+	r := &_RunfilesImpl{
+		mf: map[string]string{
+			"dep+1.2.3/data/file.txt": "/resolved/dep/data/file.txt",
+		},
+		repoMapping: map[[2]string]string{
+			{"main", "dep"}: "dep+1.2.3",
+		},
+	}
+	wrapped := WithSourceRepo(r, "main")
+
+	want := "/resolved/dep/data/file.txt"
+	if got := wrapped.Rlocation("dep/data/file.txt"); got != want {
+		t.Errorf("Rlocation = %q, want %q", got, want)
+	}
+
+	got, err := wrapped.RlocationE("dep/data/file.txt")
+	if err != nil {
+		t.Fatalf("RlocationE returned error: %v", err)
+	}
+	if got != want {
+		t.Errorf("RlocationE = %q, want %q (repo mapping not applied)", got, want)
+	}
+}
+
+func TestOpenRlocationHit(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "actual_data.txt")
+	if err := ioutil.WriteFile(target, []byte("hello runfiles"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &_RunfilesImpl{mf: map[string]string{"a/data.txt": target}}
+
+	f, err := r.OpenRlocation("a/data.txt")
+	if err != nil {
+		t.Fatalf("OpenRlocation returned error: %v", err)
+	}
+	defer f.Close()
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(got) != "hello runfiles" {
+		t.Errorf("OpenRlocation contents = %q, want %q", got, "hello runfiles")
+	}
+}
+
+func TestOpenRlocationMiss(t *testing.T) {
+	r := &_RunfilesImpl{mf: map[string]string{}}
+
+	if _, err := r.OpenRlocation("a/missing.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenRlocation error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestMaterializeTree(t *testing.T) {
+	srcDir := t.TempDir()
+	target := filepath.Join(srcDir, "actual_data.txt")
+	if err := ioutil.WriteFile(target, []byte("hello runfiles"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &_RunfilesImpl{mf: map[string]string{
+		"my_workspace/pkg/data.txt": target,
+	}}
+
+	dst := t.TempDir()
+	got, err := r.MaterializeTree(dst)
+	if err != nil {
+		t.Fatalf("MaterializeTree returned error: %v", err)
+	}
+	if got != dst {
+		t.Errorf("MaterializeTree = %q, want %q", got, dst)
+	}
+
+	linkPath := filepath.Join(dst, "my_workspace", "pkg", "data.txt")
+	contents, err := ioutil.ReadFile(linkPath)
+	if err != nil {
+		t.Fatalf("reading materialized file: %v", err)
+	}
+	if string(contents) != "hello runfiles" {
+		t.Errorf("materialized file contents = %q, want %q", contents, "hello runfiles")
+	}
+
+	if runtime.GOOS != "windows" {
+		resolved, err := os.Readlink(linkPath)
+		if err != nil {
+			t.Fatalf("Readlink(%q): %v", linkPath, err)
+		}
+		if resolved != target {
+			t.Errorf("symlink target = %q, want %q", resolved, target)
+		}
+	}
+}
+
+func TestMaterializeTreeRequiresManifest(t *testing.T) {
+	r := &_RunfilesImpl{dir: t.TempDir()}
+	if _, err := r.MaterializeTree(t.TempDir()); err == nil {
+		t.Error("MaterializeTree with no manifest: got nil error, want an error")
+	}
+}
+
+func TestRlocationEErrors(t *testing.T) {
+	r := &_RunfilesImpl{dir: "/some/dir"}
+	tests := []struct {
+		rpath   string
+		wantErr error
+	}{
+		{"", ErrEmptyRlocation},
+		{"../escape", ErrInvalidRlocation},
+		{"a/../b", ErrInvalidRlocation},
+		{"./a", ErrInvalidRlocation},
+		{"a/./b", ErrInvalidRlocation},
+		{"a/.", ErrInvalidRlocation},
+		{"a//b", ErrInvalidRlocation},
+	}
+	for _, tc := range tests {
+		_, err := r.RlocationE(tc.rpath)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("RlocationE(%q) error = %v, want %v", tc.rpath, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRlocationEValid(t *testing.T) {
+	r := &_RunfilesImpl{dir: "/some/dir"}
+	got, err := r.RlocationE("a/b.txt")
+	if err != nil {
+		t.Fatalf("RlocationE returned error: %v", err)
+	}
+	if want := "/some/dir/a/b.txt"; got != want {
+		t.Errorf("RlocationE = %q, want %q", got, want)
+	}
+}
+
+func TestReadRepoMapping(t *testing.T) {
+	dir := t.TempDir()
+	contents := "main,dep,dep+1.2.3\nmain,other,other+2.0.0\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "_repo_mapping"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readRepoMapping(dir, nil)
+	want := map[[2]string]string{
+		{"main", "dep"}:   "dep+1.2.3",
+		{"main", "other"}: "other+2.0.0",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("readRepoMapping() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("readRepoMapping()[%v] = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestReadRepoMappingAbsentIsNil(t *testing.T) {
+	dir := t.TempDir()
+	if got := readRepoMapping(dir, nil); got != nil {
+		t.Errorf("readRepoMapping() = %v, want nil", got)
+	}
+}
+
+func TestReadRepoMappingFromManifestEntry(t *testing.T) {
+	dir := t.TempDir()
+	mappingFile := filepath.Join(dir, "repo_mapping_target")
+	if err := ioutil.WriteFile(mappingFile, []byte("main,dep,dep+1.2.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mf := map[string]string{"_repo_mapping": mappingFile}
+
+	got := readRepoMapping("", mf)
+	want := map[[2]string]string{{"main", "dep"}: "dep+1.2.3"}
+	if len(got) != 1 || got[[2]string{"main", "dep"}] != want[[2]string{"main", "dep"}] {
+		t.Errorf("readRepoMapping() = %v, want %v", got, want)
+	}
+}
+